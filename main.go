@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -11,9 +13,11 @@ import (
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	flag "github.com/spf13/pflag"
@@ -69,21 +73,35 @@ var delmiter = "\n"
 type LetterKnife struct {
 	Delmiter string
 
+	Mbox bool
+
+	CharsetOverride string
+
 	ShortcutFrom    string
 	ShortcutSubject string
 	ShortcutHTML    bool
 	ShortcutPlain   bool
 
-	MatchAddress string
-	MatchHeader  string
+	MatchAddress    []string
+	MatchHeader     []string
+	MatchBody       []string
+	NotMatchAddress []string
+	NotMatchHeader  []string
+	MatchAny        bool
+	RequireHeader   bool
 
 	SelectPart       string
 	SelectAttachment string
+	SelectIndex      string
+	SelectInline     string
 
-	PrintContent bool
-	PrintHeader  string
-	PrintRaw     bool
-	SaveFile     bool
+	PrintContent     bool
+	PrintHeader      string
+	PrintRaw         bool
+	PrintJSON        bool
+	PrintHTMLInlined bool
+	ListParts        bool
+	SaveFile         bool
 
 	ModeDebug bool
 }
@@ -91,21 +109,33 @@ type LetterKnife struct {
 func (lk *LetterKnife) ParseFlags(args []string) error {
 	flags := flag.NewFlagSet("letterknife", flag.ExitOnError)
 
+	flags.BoolVar(&lk.Mbox, "mbox", false, "Input: treat input as an mbox file of multiple messages (auto-detected from a leading \"From \" line)")
+	flags.StringVar(&lk.CharsetOverride, "charset-override", "", "Input: force `<charset>` for charset decoding, for mail with a mislabeled Content-Type (eg. iso-2022-jp wrongly declared as us-ascii)")
+
 	flags.StringVar(&lk.ShortcutFrom, "from", "", "Shortcut for --match-address 'From:`<pattern>`'")
 	flags.StringVar(&lk.ShortcutSubject, "subject", "", "Shortcut for --match-header 'Subject:`<pattern>`'")
 	flags.BoolVar(&lk.ShortcutHTML, "html", false, "Shortcut for --select-part text/html")
 	flags.BoolVar(&lk.ShortcutPlain, "plain", false, "Shortcut for --select-part text/plain")
 
-	// TODO: make multiple
-	flags.StringVar(&lk.MatchAddress, "match-address", "", "Filter: address header `<header>:<pattern>` eg. \"From:*@example.com\"")
-	flags.StringVar(&lk.MatchHeader, "match-header", "", "Filter: header `<header>:<pattern>` eg. \"Subject:foobar\"")
+	flags.StringArrayVar(&lk.MatchAddress, "match-address", nil, "Filter: address header `<header>:<pattern>` eg. \"From:*@example.com\"; use \"Header@depth:pattern\" to match a forwarded/bounced message embedded at that depth. Repeatable, AND'd together (or OR'd with --match-any)")
+	flags.StringArrayVar(&lk.MatchHeader, "match-header", nil, "Filter: header `<header>:<pattern>` eg. \"Subject:foobar\"; use \"Header@depth:pattern\" to match a forwarded/bounced message embedded at that depth. Repeatable, AND'd together (or OR'd with --match-any)")
+	flags.StringArrayVar(&lk.MatchBody, "match-body", nil, "Filter: decoded text/* part content by `<pattern>`. Repeatable, AND'd together (or OR'd with --match-any)")
+	flags.StringArrayVar(&lk.NotMatchAddress, "not-match-address", nil, "Filter: negated --match-address")
+	flags.StringArrayVar(&lk.NotMatchHeader, "not-match-header", nil, "Filter: negated --match-header")
+	flags.BoolVar(&lk.MatchAny, "match-any", false, "Filter: match if any --match-* filter matches, instead of requiring all to match")
+	flags.BoolVar(&lk.RequireHeader, "require-header", false, "Filter: treat a --match-header/--match-address header that isn't present as an error instead of a non-match")
 
 	flags.StringVar(&lk.SelectPart, "select-part", "", "Select: non-attachment parts by `<content-type>`")
 	flags.StringVar(&lk.SelectAttachment, "select-attachment", "", "Select: attachments by `<content-type>`")
+	flags.StringVar(&lk.SelectIndex, "select-index", "", "Select: a single part by its `<index path>` eg. \"1.0\" (see --list-parts)")
+	flags.StringVar(&lk.SelectInline, "select-inline", "", "Select: inline embeds (Content-Disposition: inline, or any part with a Content-ID) by `<content-type>`")
 
 	flags.BoolVar(&lk.PrintContent, "print-content", false, "Action: print decoded content")
-	flags.StringVar(&lk.PrintHeader, "print-header", "", "Action: print `<header>`")
+	flags.StringVar(&lk.PrintHeader, "print-header", "", "Action: print `<header>`; use \"Header@depth\" to print a header of a forwarded/bounced message embedded at that depth")
 	flags.BoolVar(&lk.PrintRaw, "print-raw", false, "Action: print raw input as-is")
+	flags.BoolVar(&lk.PrintJSON, "print-json", false, "Action: print the MIME tree (or selected subtree) as JSON")
+	flags.BoolVar(&lk.PrintHTMLInlined, "print-html-inlined", false, "Action: print the text/html part with cid: references to inline embeds rewritten as data: URLs")
+	flags.BoolVar(&lk.ListParts, "list-parts", false, "Action: list parts with their index path, media type, disposition, filename, encoding, charset, size and Content-ID")
 	flags.BoolVar(&lk.SaveFile, "save-file", false, "Action: save parts as files and print their paths")
 
 	flags.BoolVar(&lk.ModeDebug, "debug", false, "enable debug logging")
@@ -118,14 +148,23 @@ func (lk *LetterKnife) ParseFlags(args []string) error {
 }
 
 // --from, --subject, --html, --plain
-// --match-address From:...
-// --match-header Subject:...
+// --mbox
+// --charset-override iso-2022-jp
+// --match-address From:... (repeatable)
+// --match-header Subject:... (or "Subject@1:..." for an embedded forwarded/bounced message; repeatable)
+// --match-body pattern (repeatable)
+// --match-any (OR together the --match-* filters above instead of AND)
+// --not-match-address From:..., --not-match-header Subject:...
+// --require-header
 // --select-part text/html
 // --select-attachment application/pdf
+// --select-index 1.0
+// --select-inline image/png
 // --print-content
-// --print-json // TODO
+// --print-json
+// --print-html-inlined
 // --save-file
-// --list-parts // ???
+// --list-parts
 // --debug, --quiet // TODO
 func main() {
 	l := &LetterKnife{}
@@ -141,7 +180,95 @@ func main() {
 	}
 }
 
+// Run processes r as a single message, or, if --mbox was given (or the
+// input looks like an mbox file), as a stream of messages separated by
+// "From " envelope lines.
 func (lk *LetterKnife) Run(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	isMbox := lk.Mbox
+	if !isMbox {
+		if peek, err := br.Peek(5); err == nil && string(peek) == "From " {
+			isMbox = true
+		}
+	}
+
+	if isMbox {
+		return lk.runMbox(br, w)
+	}
+
+	return lk.runMessage(br, w)
+}
+
+// runMbox splits r into individual messages and runs each one through
+// runMessage. A message that fails to match the configured filters is
+// skipped rather than aborting the run; the returned error reflects
+// whether any message matched at all.
+func (lk *LetterKnife) runMbox(r io.Reader, w io.Writer) error {
+	messages, err := splitMbox(r)
+	if err != nil {
+		return fmt.Errorf("splitting mbox: %w", err)
+	}
+
+	matched := false
+	for i, raw := range messages {
+		err := lk.runMessage(bytes.NewReader(raw), w)
+		switch {
+		case err == nil:
+			matched = true
+			fmt.Fprint(w, lk.Delmiter)
+		case errors.Is(err, ErrHeaderMatchFailed), errors.Is(err, ErrSelectFailed):
+			lk.debugf("message %d: skipped: %v", i, err)
+		default:
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+	}
+
+	if !matched {
+		return ErrHeaderMatchFailed
+	}
+
+	return nil
+}
+
+// splitMbox splits raw mbox content into the raw bytes of each contained
+// message, dropping the "From " envelope line that separates them. A
+// line is only treated as an envelope line when it follows a blank line
+// (or starts the file), so a body line escaped as ">From " is left alone.
+func splitMbox(r io.Reader) ([][]byte, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	var messages [][]byte
+	var cur bytes.Buffer
+	atBoundary := true
+
+	flush := func() {
+		if cur.Len() > 0 {
+			messages = append(messages, append([]byte(nil), cur.Bytes()...))
+			cur.Reset()
+		}
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if atBoundary && strings.HasPrefix(line, "From ") {
+			flush()
+			atBoundary = false
+			continue
+		}
+
+		cur.WriteString(line)
+		cur.WriteByte('\n')
+		atBoundary = line == ""
+	}
+	flush()
+
+	return messages, scanner.Err()
+}
+
+func (lk *LetterKnife) runMessage(r io.Reader, w io.Writer) error {
 	// holds whole input
 	var in bytes.Buffer
 
@@ -150,13 +277,13 @@ func (lk *LetterKnife) Run(r io.Reader, w io.Writer) error {
 		return fmt.Errorf("failed to read message: %w", err)
 	}
 
-	pass := true
-
+	matchAddress := lk.MatchAddress
 	if lk.ShortcutFrom != "" {
-		lk.MatchAddress = "From:" + lk.ShortcutFrom
+		matchAddress = append([]string{"From:" + lk.ShortcutFrom}, matchAddress...)
 	}
+	matchHeader := lk.MatchHeader
 	if lk.ShortcutSubject != "" {
-		lk.MatchHeader = "Subject:" + lk.ShortcutSubject
+		matchHeader = append([]string{"Subject:" + lk.ShortcutSubject}, matchHeader...)
 	}
 	if lk.ShortcutHTML {
 		lk.SelectPart = "text/html"
@@ -165,30 +292,6 @@ func (lk *LetterKnife) Run(r io.Reader, w io.Writer) error {
 		lk.SelectPart = "text/plain"
 	}
 
-	if lk.MatchAddress != "" {
-		ok, err := lk.checkMatch(msg.Header, lk.MatchAddress, true)
-		if err != nil {
-			return fmt.Errorf("checkMatch(%s): %w", lk.MatchAddress, err)
-		}
-		if !ok {
-			pass = false
-		}
-	}
-
-	if lk.MatchHeader != "" {
-		ok, err := lk.checkMatch(msg.Header, lk.MatchHeader, false)
-		if err != nil {
-			return fmt.Errorf("checkMatch(%s): %w", lk.MatchHeader, err)
-		}
-		if !ok {
-			pass = false
-		}
-	}
-
-	if !pass {
-		return ErrHeaderMatchFailed
-	}
-
 	wholePart, err := newMessagePartFromHeader(msg.Header)
 	if err != nil {
 		return fmt.Errorf("failed to create part: %w", err)
@@ -198,11 +301,19 @@ func (lk *LetterKnife) Run(r io.Reader, w io.Writer) error {
 	// body not set, but r is set
 	wholePart.r = &in
 
-	rootPart, err := buildPartTree(msg.Header, msg.Body)
+	rootPart, err := buildPartTree(msg.Header, msg.Body, "0", lk.CharsetOverride)
 	if err != nil {
 		return fmt.Errorf("while building tree: %w", err)
 	}
 
+	pass, err := lk.checkFilters(rootPart, matchAddress, matchHeader)
+	if err != nil {
+		return err
+	}
+	if !pass {
+		return ErrHeaderMatchFailed
+	}
+
 	var selectedParts []*messagePart
 	if lk.SelectPart != "" {
 		pp, err := lk.selectParts(rootPart, lk.SelectPart, false)
@@ -220,13 +331,35 @@ func (lk *LetterKnife) Run(r io.Reader, w io.Writer) error {
 		selectedParts = append(selectedParts, pp...)
 	}
 
-	if lk.SelectPart != "" || lk.SelectAttachment != "" {
-		if len(selectedParts) == 0 {
+	if lk.SelectIndex != "" {
+		p := findPartByPath(rootPart, lk.SelectIndex)
+		if p == nil {
 			return ErrSelectFailed
 		}
+		selectedParts = append(selectedParts, p)
+	}
+
+	if lk.SelectInline != "" {
+		pp, err := lk.selectInlineParts(rootPart, lk.SelectInline)
+		if err != nil {
+			return fmt.Errorf("while selecting inline parts: %w", err)
+		}
+		selectedParts = append(selectedParts, pp...)
+	}
+
+	hasSelector := lk.SelectPart != "" || lk.SelectAttachment != "" || lk.SelectIndex != "" || lk.SelectInline != ""
+	if hasSelector && len(selectedParts) == 0 {
+		return ErrSelectFailed
+	}
+
+	// what --print-json and --list-parts should walk: the matching
+	// subtree(s) if a selector was given, the whole tree otherwise.
+	treeTargets := selectedParts
+	if !hasSelector {
+		treeTargets = []*messagePart{rootPart}
 	}
 
-	if lk.PrintHeader == "" && !lk.SaveFile && !lk.PrintRaw {
+	if lk.PrintHeader == "" && !lk.SaveFile && !lk.PrintRaw && !lk.PrintJSON && !lk.ListParts && !lk.PrintHTMLInlined {
 		lk.PrintContent = true
 	}
 
@@ -242,7 +375,13 @@ func (lk *LetterKnife) Run(r io.Reader, w io.Writer) error {
 	}
 
 	if lk.PrintHeader != "" {
-		s, err := mimeDecoder.DecodeHeader(wholePart.header.Get(lk.PrintHeader))
+		depth, headerName := parseDepthQualifier(lk.PrintHeader)
+		h, ok := headerAtDepth(rootPart, depth)
+		if !ok {
+			return fmt.Errorf("--print-header: no message at depth %d", depth)
+		}
+
+		s, err := mimeDecoder.DecodeHeader(h.Get(headerName))
 		if err != nil {
 			return fmt.Errorf("decoding header %q failed: %w", lk.PrintHeader, err)
 		}
@@ -261,10 +400,97 @@ func (lk *LetterKnife) Run(r io.Reader, w io.Writer) error {
 	}
 
 	if lk.PrintRaw {
-		_, err = io.Copy(w, &in)
+		for _, mp := range selectedParts {
+			if mp == wholePart {
+				if _, err := io.Copy(w, &in); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if mp.isMultipart() {
+				return fmt.Errorf("part %s is a container (multipart or embedded message) and has no raw content of its own; select a leaf part instead", mp.path)
+			}
+
+			if _, err := w.Write(mp.raw.Bytes()); err != nil {
+				return err
+			}
+			fmt.Fprint(w, delmiter)
+		}
+	}
+
+	if lk.ListParts {
+		for _, mp := range treeTargets {
+			if err := lk.listParts(w, mp); err != nil {
+				return err
+			}
+		}
+	}
+
+	if lk.PrintJSON {
+		if err := lk.printJSON(w, treeTargets, len(treeTargets) > 1); err != nil {
+			return err
+		}
+	}
+
+	if lk.PrintHTMLInlined && !lk.SaveFile {
+		htmlPart, err := lk.findHTMLPart(rootPart, hasSelector, treeTargets)
+		if err != nil {
+			return err
+		}
+
+		content, err := io.ReadAll(htmlPart)
+		if err != nil {
+			return err
+		}
+
+		inlined, err := inlineHTMLDataURIs(string(content), rootPart)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprint(w, inlined)
+		fmt.Fprint(w, delmiter)
+	}
+
+	if lk.SaveFile && lk.PrintHTMLInlined {
+		htmlPart, err := lk.findHTMLPart(rootPart, hasSelector, treeTargets)
+		if err != nil {
+			return err
+		}
+
+		content, err := io.ReadAll(htmlPart)
+		if err != nil {
+			return err
+		}
+
+		dir, err := os.MkdirTemp("", "")
+		if err != nil {
+			return fmt.Errorf("while creating temporary directory: %w", err)
+		}
+
+		rewritten, savedPaths, err := lk.saveInlinedHTML(dir, string(content), rootPart)
 		if err != nil {
 			return err
 		}
+
+		f, err := os.CreateTemp(dir, "*.html")
+		if err != nil {
+			return fmt.Errorf("creating file: %w", err)
+		}
+		if _, err := f.WriteString(rewritten); err != nil {
+			return err
+		}
+		f.Close()
+
+		fmt.Fprint(w, f.Name())
+		fmt.Fprint(w, delmiter)
+		for _, path := range savedPaths {
+			fmt.Fprint(w, path)
+			fmt.Fprint(w, delmiter)
+		}
+
+		return nil
 	}
 
 	if lk.SaveFile {
@@ -310,16 +536,30 @@ func (lk *LetterKnife) Run(r io.Reader, w io.Writer) error {
 }
 
 type messagePart struct {
+	// path is the dotted index path identifying this part within the
+	// tree, eg. "0.1" for the second subpart of the root part. It is
+	// stable for a given input and is what --select-index matches against.
+	path string
+
 	header          mail.Header
 	mediaType       string
 	mediaTypeParams map[string]string
 
+	// charsetOverride, if non-empty, overrides mediaTypeParams["charset"]
+	// when decoding text in Read. Set from --charset-override.
+	charsetOverride string
+
 	r io.Reader
 
 	// either is defined
 	body     *bytes.Buffer
 	subparts []*messagePart
 
+	// raw holds the part's body exactly as received, before
+	// Content-Transfer-Encoding decoding. Only set for leaf parts; backs
+	// --print-raw when a part is selected and --print-json's encoded size.
+	raw *bytes.Buffer
+
 	disposition       string
 	dispositionParams map[string]string
 }
@@ -341,16 +581,22 @@ func (r *errWrappedReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
-// Read implements io.Reader
+// Read implements io.Reader. m.body already holds CTE-decoded bytes (see
+// buildPartTree); charset decoding is the only thing left to do lazily.
 func (m *messagePart) Read(p []byte) (n int, err error) {
 	if m.r == nil {
+		if m.isMultipart() {
+			return 0, fmt.Errorf("part %s is a container (multipart or embedded message) and has no content of its own; select a leaf part instead", m.path)
+		}
+
 		var r io.Reader = m.body
 
-		if strings.EqualFold(m.header.Get("Content-Transfer-Encoding"), "base64") {
-			r = base64.NewDecoder(base64.StdEncoding, r)
+		charset := m.mediaTypeParams["charset"]
+		if m.charsetOverride != "" {
+			charset = m.charsetOverride
 		}
 
-		if charset := m.mediaTypeParams["charset"]; charset != "" {
+		if charset != "" {
 			enc, err := ianaindex.MIME.Encoding(charset)
 			if err != nil {
 				return 0, fmt.Errorf("failed to build charset %q decoder: %v", charset, err)
@@ -369,6 +615,44 @@ func (m *messagePart) Read(p []byte) (n int, err error) {
 	return m.r.Read(p)
 }
 
+// decodedBody returns the part's body with its Content-Transfer-Encoding
+// already removed (see buildPartTree), but without any charset
+// conversion applied (unlike Read).
+func (m *messagePart) decodedBody() ([]byte, error) {
+	return m.body.Bytes(), nil
+}
+
+// textBody returns the part's body with both its Content-Transfer-Encoding
+// and its charset decoded, independent of Read's cached reader. Unlike
+// Read, it performs the decode fresh each call, so it's safe to use for
+// a one-off inspection (eg. --match-body) without disturbing a part that
+// may still be read from later.
+func (m *messagePart) textBody() ([]byte, error) {
+	body, err := m.decodedBody()
+	if err != nil {
+		return nil, err
+	}
+
+	charset := m.mediaTypeParams["charset"]
+	if m.charsetOverride != "" {
+		charset = m.charsetOverride
+	}
+	if charset == "" {
+		return body, nil
+	}
+
+	enc, err := ianaindex.MIME.Encoding(charset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build charset %q decoder: %v", charset, err)
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", charset, err)
+	}
+	return decoded, nil
+}
+
 func (m *messagePart) isMultipart() bool {
 	return m.body == nil
 }
@@ -380,6 +664,13 @@ func (m *messagePart) attachmentFilename() (string, bool) {
 	return m.dispositionParams["filename"], true
 }
 
+// inlineID returns the part's Content-ID with its surrounding angle
+// brackets stripped, or "" if it has none. It identifies inline embeds
+// (Content-Disposition: inline) referenced from HTML via cid: URLs.
+func (m *messagePart) inlineID() string {
+	return strings.Trim(m.header.Get("Content-Id"), "<>")
+}
+
 func newMessagePartFromHeader(header mail.Header) (*messagePart, error) {
 	ct := header.Get("Content-Type")
 	mt, params, err := mime.ParseMediaType(ct)
@@ -398,15 +689,17 @@ func newMessagePartFromHeader(header mail.Header) (*messagePart, error) {
 	}, nil
 }
 
-func buildPartTree(header mail.Header, body io.Reader) (*messagePart, error) {
+func buildPartTree(header mail.Header, body io.Reader, path, charsetOverride string) (*messagePart, error) {
 	part, err := newMessagePartFromHeader(header)
 	if err != nil {
 		return nil, err
 	}
+	part.path = path
+	part.charsetOverride = charsetOverride
 
 	if strings.HasPrefix(part.mediaType, "multipart/") && part.mediaTypeParams["boundary"] != "" {
 		mr := multipart.NewReader(body, part.mediaTypeParams["boundary"])
-		for {
+		for i := 0; ; i++ {
 			p, err := mr.NextPart()
 			if err == io.EOF {
 				break
@@ -414,7 +707,7 @@ func buildPartTree(header mail.Header, body io.Reader) (*messagePart, error) {
 				return nil, fmt.Errorf("reading multipart: %v", err)
 			}
 
-			subpart, err := buildPartTree(mail.Header(p.Header), p)
+			subpart, err := buildPartTree(mail.Header(p.Header), p, fmt.Sprintf("%s.%d", path, i), charsetOverride)
 			if err != nil {
 				return nil, err
 			}
@@ -423,16 +716,102 @@ func buildPartTree(header mail.Header, body io.Reader) (*messagePart, error) {
 		return part, nil
 	}
 
+	if isEmbeddedMessageType(part.mediaType) {
+		inner, err := mail.ReadMessage(body)
+		if err != nil {
+			return nil, fmt.Errorf("reading embedded message: %v", err)
+		}
+
+		innerPart, err := buildPartTree(inner.Header, inner.Body, path+".0", charsetOverride)
+		if err != nil {
+			return nil, err
+		}
+		part.subparts = []*messagePart{innerPart}
+		return part, nil
+	}
+
+	part.raw = new(bytes.Buffer)
 	part.body = new(bytes.Buffer)
-	if strings.EqualFold(part.header.Get("Content-Transfer-Encoding"), "quoted-printable") {
-		body = quotedprintable.NewReader(body)
+
+	decoded, err := decodeCTE(io.TeeReader(body, part.raw), part.header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = io.Copy(part.body, body)
+	_, err = io.Copy(part.body, decoded)
 
 	return part, err
 }
 
+// decodeCTE wraps r with a decoder for the given Content-Transfer-Encoding.
+// 7bit, 8bit, binary and unrecognized encodings pass through unchanged.
+func decodeCTE(r io.Reader, cte string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r), nil
+	case "quoted-printable":
+		return quotedprintable.NewReader(r), nil
+	case "x-uuencode", "uuencode":
+		return uuDecode(r)
+	default:
+		// "", "7bit", "8bit", "binary" and anything else we don't
+		// recognize are passed through as-is.
+		return r, nil
+	}
+}
+
+// uuDecode decodes classic uuencoded content (the "begin ... / end"
+// format produced by the uuencode(1) utility).
+func uuDecode(r io.Reader) (io.Reader, error) {
+	var out bytes.Buffer
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line == "`" || line == "end" || strings.HasPrefix(line, "begin ") {
+			continue
+		}
+
+		decoded, err := uuDecodeLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("decoding uuencoded line: %w", err)
+		}
+		out.Write(decoded)
+	}
+
+	return &out, scanner.Err()
+}
+
+// uuDecodeLine decodes a single line of uuencoded data: a length byte
+// followed by groups of 4 characters each encoding 3 bytes.
+func uuDecodeLine(line string) ([]byte, error) {
+	n := int(line[0]-' ') & 0x3f
+	if n == 0 {
+		return nil, nil
+	}
+
+	encoded := line[1:]
+	decoded := make([]byte, 0, n)
+
+	for i := 0; i+4 <= len(encoded) && len(decoded) < n; i += 4 {
+		var c [4]byte
+		for j := 0; j < 4; j++ {
+			c[j] = (encoded[i+j] - ' ') & 0x3f
+		}
+		decoded = append(decoded,
+			c[0]<<2|c[1]>>4,
+			c[1]<<4|c[2]>>2,
+			c[2]<<6|c[3],
+		)
+	}
+
+	if len(decoded) > n {
+		decoded = decoded[:n]
+	}
+
+	return decoded, nil
+}
+
 func (lk *LetterKnife) visitParts(mp *messagePart, visit func(*messagePart) error) error {
 	lk.debugf("visitParts: %v sub=%v", mp.header.Get("Content-Type"), mp.subparts)
 
@@ -448,6 +827,181 @@ func (lk *LetterKnife) visitParts(mp *messagePart, visit func(*messagePart) erro
 	return visit(mp)
 }
 
+// isEmbeddedMessageType reports whether a part carrying this media type
+// embeds another whole message (forwarded mail, bounce notifications)
+// that buildPartTree should recurse into.
+func isEmbeddedMessageType(mediaType string) bool {
+	switch mediaType {
+	case "message/rfc822", "message/delivery-status", "message/global":
+		return true
+	}
+	return false
+}
+
+// firstEmbeddedMessage finds the first embedded message part (in
+// pre-order) within mp's tree and returns its single subpart, ie. the
+// embedded message itself.
+func firstEmbeddedMessage(mp *messagePart) *messagePart {
+	if isEmbeddedMessageType(mp.mediaType) && len(mp.subparts) == 1 {
+		return mp.subparts[0]
+	}
+	for _, p := range mp.subparts {
+		if found := firstEmbeddedMessage(p); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// headerAtDepth resolves the header of the message found by descending
+// through `depth` levels of embedded messages, starting at the outermost
+// message's own header for depth 0. This backs the "Header@depth:..."
+// qualifier accepted by --match-header and --print-header.
+func headerAtDepth(root *messagePart, depth int) (mail.Header, bool) {
+	cur := root
+	for i := 0; i < depth; i++ {
+		next := firstEmbeddedMessage(cur)
+		if next == nil {
+			return nil, false
+		}
+		cur = next
+	}
+	return cur.header, true
+}
+
+// parseDepthQualifier splits a "Header@depth" spec into the header name
+// and the depth (0 if unqualified).
+func parseDepthQualifier(spec string) (depth int, header string) {
+	if at := strings.IndexByte(spec, '@'); at != -1 {
+		if d, err := strconv.Atoi(spec[at+1:]); err == nil {
+			return d, spec[:at]
+		}
+	}
+	return 0, spec
+}
+
+// findPartByPath looks up the part at the given dotted index path (as
+// assigned by buildPartTree), searching the whole tree including
+// multipart container parts themselves.
+func findPartByPath(mp *messagePart, path string) *messagePart {
+	if mp.path == path {
+		return mp
+	}
+	for _, p := range mp.subparts {
+		if found := findPartByPath(p, path); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (lk *LetterKnife) listParts(w io.Writer, mp *messagePart) error {
+	return lk.visitParts(mp, func(mp *messagePart) error {
+		filename, _ := mp.attachmentFilename()
+		contentID := strings.Trim(mp.header.Get("Content-Id"), "<>")
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s%s",
+			mp.path,
+			mp.mediaType,
+			mp.disposition,
+			filename,
+			mp.header.Get("Content-Transfer-Encoding"),
+			mp.mediaTypeParams["charset"],
+			mp.body.Len(),
+			contentID,
+			lk.Delmiter,
+		)
+
+		return nil
+	})
+}
+
+// partJSON is the JSON representation of a messagePart as emitted by
+// --print-json.
+type partJSON struct {
+	Path string `json:"path"`
+
+	Header            map[string][]string `json:"header"`
+	MediaType         string              `json:"mediaType"`
+	MediaTypeParams   map[string]string   `json:"mediaTypeParams,omitempty"`
+	Disposition       string              `json:"disposition,omitempty"`
+	DispositionParams map[string]string   `json:"dispositionParams,omitempty"`
+
+	EncodedSize int    `json:"encodedSize,omitempty"`
+	DecodedSize int    `json:"decodedSize,omitempty"`
+	Body        string `json:"body,omitempty"`
+	BodyBase64  string `json:"bodyBase64,omitempty"`
+
+	Subparts []*partJSON `json:"subparts,omitempty"`
+}
+
+func (mp *messagePart) toJSON() (*partJSON, error) {
+	pj := &partJSON{
+		Path:              mp.path,
+		Header:            map[string][]string(mp.header),
+		MediaType:         mp.mediaType,
+		MediaTypeParams:   mp.mediaTypeParams,
+		Disposition:       mp.disposition,
+		DispositionParams: mp.dispositionParams,
+	}
+
+	if mp.isMultipart() {
+		for _, p := range mp.subparts {
+			sub, err := p.toJSON()
+			if err != nil {
+				return nil, err
+			}
+			pj.Subparts = append(pj.Subparts, sub)
+		}
+		return pj, nil
+	}
+
+	pj.EncodedSize = mp.raw.Len()
+
+	decoded, err := mp.decodedBody()
+	if err != nil {
+		return nil, err
+	}
+	pj.DecodedSize = len(decoded)
+
+	if strings.HasPrefix(mp.mediaType, "text/") {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, mp); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", mp.path, err)
+		}
+		pj.Body = buf.String()
+	} else {
+		pj.BodyBase64 = base64.StdEncoding.EncodeToString(decoded)
+	}
+
+	return pj, nil
+}
+
+// printJSON encodes targets as JSON: a bare object for a single target
+// (eg. no selector, or a selector that narrowed to exactly one part, as
+// --select-index always does), an array otherwise.
+func (lk *LetterKnife) printJSON(w io.Writer, targets []*messagePart, asArray bool) error {
+	enc := json.NewEncoder(w)
+
+	if asArray {
+		trees := make([]*partJSON, 0, len(targets))
+		for _, mp := range targets {
+			pj, err := mp.toJSON()
+			if err != nil {
+				return err
+			}
+			trees = append(trees, pj)
+		}
+		return enc.Encode(trees)
+	}
+
+	pj, err := targets[0].toJSON()
+	if err != nil {
+		return err
+	}
+	return enc.Encode(pj)
+}
+
 func (lk *LetterKnife) selectParts(mp *messagePart, mediaTypeSpec string, isAttachmentSpec bool) ([]*messagePart, error) {
 	parts := []*messagePart{}
 	err := lk.visitParts(mp, func(mp *messagePart) error {
@@ -474,14 +1028,301 @@ func (lk *LetterKnife) selectParts(mp *messagePart, mediaTypeSpec string, isAtta
 	return parts, nil
 }
 
+// selectInlineParts selects parts marked as inline embeds, ie. those with
+// Content-Disposition: inline or any part carrying a Content-ID, whose
+// media type matches mediaTypeSpec.
+func (lk *LetterKnife) selectInlineParts(mp *messagePart, mediaTypeSpec string) ([]*messagePart, error) {
+	parts := []*messagePart{}
+	err := lk.visitParts(mp, func(mp *messagePart) error {
+		if mp.disposition != "inline" && mp.inlineID() == "" {
+			return nil
+		}
+
+		ok, err := testPattern(mp.mediaType, mediaTypeSpec)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			parts = append(parts, mp)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+// findPartByContentID looks up the part carrying the given Content-ID
+// (without angle brackets) anywhere in mp's tree.
+func findPartByContentID(mp *messagePart, cid string) *messagePart {
+	if mp.inlineID() == cid {
+		return mp
+	}
+	for _, p := range mp.subparts {
+		if found := findPartByContentID(p, cid); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// rxCIDRef matches an HTML attribute referencing an inline embed via a
+// cid: URL, eg. src="cid:image1". RE2 has no backreferences, so the two
+// quote styles are matched as separate non-capturing alternatives rather
+// than requiring the closing quote to match the opening one.
+var rxCIDRef = regexp.MustCompile(`(src|href|background)=(?:"cid:([^"]+)"|'cid:([^']+)')`)
+
+// cidRefParts extracts the attribute name, the quote character in use, and
+// the referenced Content-ID from a rxCIDRef submatch slice.
+func cidRefParts(sub []string) (attr, quote, cid string) {
+	if sub[2] != "" {
+		return sub[1], `"`, sub[2]
+	}
+	return sub[1], `'`, sub[3]
+}
+
+// findHTMLPart locates the text/html part --print-html-inlined should
+// operate on: the selected part if a selector picked exactly a
+// text/html part, or the first text/html part in the tree otherwise.
+func (lk *LetterKnife) findHTMLPart(root *messagePart, hasSelector bool, candidates []*messagePart) (*messagePart, error) {
+	if hasSelector {
+		for _, p := range candidates {
+			if p.mediaType == "text/html" {
+				return p, nil
+			}
+		}
+		return nil, fmt.Errorf("--print-html-inlined: selected part(s) do not include a text/html part")
+	}
+
+	pp, err := lk.selectParts(root, "text/html", false)
+	if err != nil {
+		return nil, err
+	}
+	if len(pp) == 0 {
+		return nil, fmt.Errorf("--print-html-inlined: no text/html part found")
+	}
+
+	return pp[0], nil
+}
+
+// inlineHTMLDataURIs rewrites cid: references in html to data: URLs,
+// resolving each one against root's inline embeds so the result renders
+// standalone in a browser.
+func inlineHTMLDataURIs(html string, root *messagePart) (string, error) {
+	var outerErr error
+
+	rewritten := rxCIDRef.ReplaceAllStringFunc(html, func(m string) string {
+		sub := rxCIDRef.FindStringSubmatch(m)
+		attr, quote, cid := cidRefParts(sub)
+
+		part := findPartByContentID(root, cid)
+		if part == nil {
+			return m
+		}
+
+		data, err := part.decodedBody()
+		if err != nil {
+			outerErr = fmt.Errorf("decoding inline embed %q: %w", cid, err)
+			return m
+		}
+
+		uri := "data:" + part.mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+		return attr + "=" + quote + uri + quote
+	})
+
+	return rewritten, outerErr
+}
+
+// saveInlinedHTML saves each inline embed referenced from html by a
+// cid: URL into dir (named after its Content-ID, falling back to its
+// attachment filename) and rewrites those references to the relative
+// filenames. It returns the rewritten HTML and the saved file paths.
+func (lk *LetterKnife) saveInlinedHTML(dir, html string, root *messagePart) (string, []string, error) {
+	var savedPaths []string
+	var outerErr error
+
+	rewritten := rxCIDRef.ReplaceAllStringFunc(html, func(m string) string {
+		sub := rxCIDRef.FindStringSubmatch(m)
+		attr, quote, cid := cidRefParts(sub)
+
+		part := findPartByContentID(root, cid)
+		if part == nil {
+			return m
+		}
+
+		filename, _ := part.attachmentFilename()
+		if filename == "" {
+			filename = cid + extensionsByType(part.mediaType)
+		}
+
+		f, err := os.Create(filepath.Join(dir, filename))
+		if err != nil {
+			outerErr = fmt.Errorf("creating file: %w", err)
+			return m
+		}
+		if _, err := io.Copy(f, part); err != nil {
+			f.Close()
+			outerErr = err
+			return m
+		}
+		f.Close()
+
+		savedPaths = append(savedPaths, f.Name())
+		return attr + "=" + quote + filename + quote
+	})
+
+	return rewritten, savedPaths, outerErr
+}
+
+// checkFilters evaluates all configured --match-* filters against a
+// single message's part tree. By default every filter must match
+// (--match-any switches this to "any filter matches"); --not-match-*
+// filters are always required to NOT match, regardless of --match-any.
+func (lk *LetterKnife) checkFilters(root *messagePart, matchAddress, matchHeader []string) (bool, error) {
+	var results []bool
+
+	for _, spec := range matchAddress {
+		ok, err := lk.checkMatchSpec(root, spec, true)
+		if err != nil {
+			return false, fmt.Errorf("checkMatch(%s): %w", spec, err)
+		}
+		results = append(results, ok)
+	}
+
+	for _, spec := range matchHeader {
+		ok, err := lk.checkMatchSpec(root, spec, false)
+		if err != nil {
+			return false, fmt.Errorf("checkMatch(%s): %w", spec, err)
+		}
+		results = append(results, ok)
+	}
+
+	for _, pattern := range lk.MatchBody {
+		ok, err := lk.checkMatchBody(root, pattern)
+		if err != nil {
+			return false, fmt.Errorf("matchBody(%s): %w", pattern, err)
+		}
+		results = append(results, ok)
+	}
+
+	pass := true
+	if len(results) > 0 {
+		if lk.MatchAny {
+			pass = false
+			for _, ok := range results {
+				if ok {
+					pass = true
+					break
+				}
+			}
+		} else {
+			for _, ok := range results {
+				if !ok {
+					pass = false
+					break
+				}
+			}
+		}
+	}
+
+	for _, spec := range lk.NotMatchAddress {
+		if !pass {
+			break
+		}
+		ok, err := lk.checkMatchSpec(root, spec, true)
+		if err != nil {
+			return false, fmt.Errorf("checkMatch(%s): %w", spec, err)
+		}
+		if ok {
+			pass = false
+		}
+	}
+
+	for _, spec := range lk.NotMatchHeader {
+		if !pass {
+			break
+		}
+		ok, err := lk.checkMatchSpec(root, spec, false)
+		if err != nil {
+			return false, fmt.Errorf("checkMatch(%s): %w", spec, err)
+		}
+		if ok {
+			pass = false
+		}
+	}
+
+	return pass, nil
+}
+
+// checkMatchBody reports whether any decoded text/* part's content
+// contains pattern, searching unanchored (unlike header matching, a body
+// is multi-line and the pattern is expected to match somewhere within it,
+// not the whole thing). It reads via textBody rather than Read so that
+// filtering never disturbs a part's reader for a later content-printing
+// pass.
+func (lk *LetterKnife) checkMatchBody(root *messagePart, pattern string) (bool, error) {
+	matched := false
+
+	err := lk.visitParts(root, func(mp *messagePart) error {
+		if matched || !strings.HasPrefix(mp.mediaType, "text/") {
+			return nil
+		}
+
+		content, err := mp.textBody()
+		if err != nil {
+			return err
+		}
+
+		ok, err := testBodyPattern(string(content), pattern)
+		if err != nil {
+			return err
+		}
+		if ok {
+			matched = true
+		}
+
+		return nil
+	})
+
+	return matched, err
+}
+
+// checkMatchSpec resolves the optional "Header@depth:pattern" qualifier
+// against root's embedded-message tree and checks the match against the
+// header found there.
+func (lk *LetterKnife) checkMatchSpec(root *messagePart, spec string, isAddr bool) (bool, error) {
+	p := strings.IndexByte(spec, ':')
+	if p == -1 {
+		return false, fmt.Errorf("must be in the form of `header:pattern`: %q", spec)
+	}
+	depth, header := parseDepthQualifier(spec[:p])
+
+	h, ok := headerAtDepth(root, depth)
+	if !ok {
+		return false, nil
+	}
+
+	return lk.checkMatch(h, header+spec[p:], isAddr)
+}
+
 func (lk *LetterKnife) checkMatch(h mail.Header, in string, isAddr bool) (bool, error) {
-	// TODO: fail if header does not exist
 	p := strings.IndexByte(in, ':')
 	if p == -1 {
 		return false, fmt.Errorf("must be in the form of `header:pattern`: %q", in)
 	}
 	header, pattern := in[0:p], in[p+1:]
 
+	if _, ok := h[textproto.CanonicalMIMEHeaderKey(header)]; !ok {
+		if lk.RequireHeader {
+			return false, fmt.Errorf("required header %q not present", header)
+		}
+		return false, nil
+	}
+
 	var values []string
 	if isAddr {
 		addrs, err := (&mail.AddressParser{WordDecoder: mimeDecoder}).ParseList(h.Get(header))
@@ -545,3 +1386,37 @@ func testPattern(value, pattern string) (bool, error) {
 
 	return rx.MatchString(value), nil
 }
+
+// regexpFromBodyPattern is regexpFromPattern without the ^...$ anchors and
+// with "*" translated to a dot-matches-newline ".*": a body is multi-line
+// and the pattern is meant to match a piece of it, not the whole string.
+func regexpFromBodyPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+
+	p := rxPattern.ReplaceAllStringFunc(pattern, func(s string) string {
+		if s == "*" {
+			return ".*"
+		} else {
+			return regexp.QuoteMeta(s)
+		}
+	})
+	return regexp.Compile("(?s)" + p)
+}
+
+// testBodyPattern is testPattern's unanchored counterpart for
+// --match-body: it reports whether pattern matches anywhere in value
+// rather than requiring value to match pattern in full.
+func testBodyPattern(value, pattern string) (bool, error) {
+	if strings.IndexByte(pattern, '*') == -1 && (pattern[0] != '/' && pattern[len(pattern)-1] != '/') {
+		return strings.Contains(value, pattern), nil
+	}
+
+	rx, err := regexpFromBodyPattern(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	return rx.MatchString(value), nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -79,6 +81,189 @@ func TestRunMain_SaveFile(t *testing.T) {
 		lines := buf.String()
 		assert.Check(t, cmp.Regexp(`(?m)4x4\.png$`, lines))
 	})
+
+	t.Run("round-trips a base64 attachment's decoded bytes", func(t *testing.T) {
+		buf, err := runLetterKnife(t, []string{"--select-attachment=*", "--save-file"}, "multipart.eml")
+		assert.NilError(t, err)
+
+		path := strings.Split(buf.String(), "\n")[0]
+		saved, err := os.ReadFile(path)
+		assert.NilError(t, err)
+
+		// a decoded PNG, not the raw base64 text still sitting in the message
+		assert.Check(t, cmp.Equal(string(saved[:4]), "\x89PNG"))
+	})
+
+	t.Run("decodes a mixed-encoding multipart message", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--select-attachment=image/png", "--save-file"}, "mixed-encoding.eml")
+		assert.NilError(t, err)
+
+		path := strings.Split(out.String(), "\n")[0]
+		saved, err := os.ReadFile(path)
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Equal(string(saved[:4]), "\x89PNG"))
+
+		text, err := runLetterKnife(t, []string{"--plain"}, "mixed-encoding.eml")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Contains(text.String(), "Hello"))
+	})
+}
+
+func TestRunMain_ListParts(t *testing.T) {
+	out, err := runLetterKnife(t, []string{"--list-parts"}, "multipart.eml")
+	assert.NilError(t, err)
+
+	lines := out.String()
+	assert.Check(t, cmp.Contains(lines, "0.0\ttext/plain"))
+	assert.Check(t, cmp.Contains(lines, "0.1\ttext/html"))
+	assert.Check(t, cmp.Contains(lines, "0.2\timage/png\tattachment\t4x4.png"))
+}
+
+func TestRunMain_PrintJSON(t *testing.T) {
+	out, err := runLetterKnife(t, []string{"--print-json"}, "multipart.eml")
+	assert.NilError(t, err)
+
+	var tree partJSON
+	assert.NilError(t, json.Unmarshal(out.Bytes(), &tree))
+	assert.Check(t, cmp.Equal(tree.MediaType, "multipart/mixed"))
+	assert.Check(t, cmp.Len(tree.Subparts, 3))
+
+	png := tree.Subparts[2]
+	assert.Check(t, cmp.Equal(png.MediaType, "image/png"))
+	assert.Check(t, cmp.Equal(png.EncodedSize, 86))
+	assert.Check(t, cmp.Equal(png.DecodedSize, 62))
+}
+
+func TestRunMain_PrintRaw(t *testing.T) {
+	t.Run("prints raw input if none is selected", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--print-raw"}, "plain.eml")
+		assert.NilError(t, err)
+
+		in, err := os.ReadFile("testdata/plain.eml")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Equal(string(in), out.String()))
+	})
+
+	t.Run("prints the still-encoded bytes of the selected part", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--select-attachment=image/png", "--print-raw"}, "multipart.eml")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Contains(out.String(), "iVBORw0KGgpGQUtFLVBORy1CWVRFUy1GT1ItTEVUVEVSS05JRkUtVEVTVC1GSVhUVVJFLTAxMjM0"))
+		assert.Check(t, !strings.Contains(out.String(), "\x89PNG"))
+	})
+}
+
+func TestRunMain_SelectIndex(t *testing.T) {
+	t.Run("selects the part at the given index path", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--select-index", "0.0", "--print-content"}, "multipart.eml")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Contains(out.String(), "Hello! 😊"))
+	})
+
+	t.Run("fails when no part has that index path", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--select-index", "9.9"}, "multipart.eml")
+		assert.ErrorIs(t, err, ErrSelectFailed)
+	})
+
+	t.Run("--print-json encodes a bare object, not a one-element array", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--select-index", "0.0", "--print-json"}, "multipart.eml")
+		assert.NilError(t, err)
+
+		var pj partJSON
+		assert.NilError(t, json.Unmarshal(out.Bytes(), &pj))
+		assert.Check(t, cmp.Equal(pj.Path, "0.0"))
+	})
+
+	t.Run("still recurses a container part for --print-json", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--select-index", "0", "--print-json"}, "multipart.eml")
+		assert.NilError(t, err)
+
+		var pj partJSON
+		assert.NilError(t, json.Unmarshal(out.Bytes(), &pj))
+		assert.Check(t, cmp.Equal(pj.Path, "0"))
+		assert.Check(t, cmp.Len(pj.Subparts, 3))
+	})
+
+	t.Run("fails cleanly instead of panicking when the index names a container part", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--select-index", "0"}, "multipart.eml")
+		assert.ErrorContains(t, err, "is a container")
+	})
+
+	t.Run("fails cleanly for a message/rfc822 wrapper part", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--select-index", "0.1"}, "forwarded.eml")
+		assert.ErrorContains(t, err, "is a container")
+	})
+}
+
+func TestRunMain_Mbox(t *testing.T) {
+	t.Run("processes each message and filters them independently", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--mbox", "--from", "motemen@gmail.com", "--plain"}, "sample.mbox")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Contains(out.String(), "Hello from the first message."))
+		assert.Check(t, !strings.Contains(out.String(), "Hello from the second message."))
+	})
+
+	t.Run("a body line escaped with '>From ' isn't treated as a message boundary", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--mbox", "--plain"}, "sample.mbox")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Contains(out.String(), "the archives, we found this quote"))
+	})
+
+	t.Run("fails when no message in the mbox matches", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--mbox", "--from", "nobody@example.com"}, "sample.mbox")
+		assert.ErrorIs(t, err, ErrHeaderMatchFailed)
+	})
+}
+
+func TestRunMain_EmbeddedMessage(t *testing.T) {
+	t.Run("--print-header with a depth qualifier reads the embedded message's header", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--print-header", "Subject@1"}, "forwarded.eml")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Equal(strings.TrimSpace(out.String()), "Original subject"))
+	})
+
+	t.Run("--print-header without a depth qualifier reads the outer header", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--print-header", "Subject"}, "forwarded.eml")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Equal(strings.TrimSpace(out.String()), "Fwd: Original subject"))
+	})
+
+	t.Run("--match-address with a depth qualifier matches the embedded message's address header", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--match-address", "From@1:original@example.com"}, "forwarded.eml")
+		assert.NilError(t, err)
+	})
+
+	t.Run("--print-header fails past the last embedded message", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--print-header", "Subject@2"}, "forwarded.eml")
+		assert.Check(t, err != nil)
+	})
+}
+
+func TestRunMain_InlineHTML(t *testing.T) {
+	t.Run("--select-inline selects the inline embed by media type", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--select-inline", "image/png", "--print-content"}, "inline-html.eml")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Equal(strings.TrimSpace(out.String()), "hello"))
+	})
+
+	t.Run("--print-html-inlined rewrites cid: references as data: URLs", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--print-html-inlined"}, "inline-html.eml")
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Contains(out.String(), `src="data:image/png;base64,aGVsbG8="`))
+	})
+
+	t.Run("--print-html-inlined --save-file saves the HTML and its inline embeds as separate files", func(t *testing.T) {
+		out, err := runLetterKnife(t, []string{"--print-html-inlined", "--save-file"}, "inline-html.eml")
+		assert.NilError(t, err)
+
+		lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+		assert.Check(t, cmp.Len(lines, 2))
+		assert.Check(t, cmp.Regexp(`\.html$`, lines[0]))
+		assert.Check(t, cmp.Regexp(`\.png$`, lines[1]))
+
+		html, err := os.ReadFile(lines[0])
+		assert.NilError(t, err)
+		assert.Check(t, cmp.Contains(string(html), `src="`+filepath.Base(lines[1])+`"`))
+	})
 }
 
 func TestRunMain_MatchHeader(t *testing.T) {
@@ -93,6 +278,45 @@ func TestRunMain_MatchAddress(t *testing.T) {
 	assert.NilError(t, err)
 }
 
+func TestRunMain_MatchHeader_Repeatable(t *testing.T) {
+	t.Run("multiple --match-header are AND'd by default", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{
+			"--match-header", "Subject:*mail ✉️",
+			"--match-header", "Subject:Hello️",
+		}, "plain.eml")
+		assert.ErrorIs(t, err, ErrHeaderMatchFailed)
+	})
+
+	t.Run("--match-any ORs them instead", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{
+			"--match-any",
+			"--match-header", "Subject:*mail ✉️",
+			"--match-header", "Subject:Hello️",
+		}, "plain.eml")
+		assert.NilError(t, err)
+	})
+
+	t.Run("--not-match-header rejects a matching message", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--not-match-header", "Subject:*mail ✉️"}, "plain.eml")
+		assert.ErrorIs(t, err, ErrHeaderMatchFailed)
+	})
+
+	t.Run("a missing header is a non-match, not an error", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--match-header", "X-No-Such-Header:*"}, "plain.eml")
+		assert.ErrorIs(t, err, ErrHeaderMatchFailed)
+	})
+
+	t.Run("--require-header turns a missing header into an error", func(t *testing.T) {
+		_, err := runLetterKnife(t, []string{"--require-header", "--match-header", "X-No-Such-Header:*"}, "plain.eml")
+		assert.Check(t, err != nil && !errors.Is(err, ErrHeaderMatchFailed))
+	})
+}
+
+func TestRunMain_MatchBody(t *testing.T) {
+	_, err := runLetterKnife(t, []string{"--match-body", "*mail*"}, "plain.eml")
+	assert.NilError(t, err)
+}
+
 func TestRegexpFromPattern(t *testing.T) {
 	tests := []struct {
 		pattern string